@@ -0,0 +1,173 @@
+package zerver
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	websocket "github.com/cosiner/zerver_websocket"
+)
+
+type (
+	maxInFlightFilter struct {
+		sem chan struct{}
+	}
+
+	requestTimeoutFilter struct {
+		timeout     time.Duration
+		longRunning func(*http.Request) bool
+	}
+
+	// pendingCleanup lets whichever of dispatch or a timed-out
+	// requestTimeoutFilter finishes with a request's pooled req/resp/filters
+	// last be the one that releases them, see registerCleanup.
+	pendingCleanup struct {
+		fn      func()
+		claimed int32 // atomic; CAS 0->1, the winner owns calling fn
+	}
+)
+
+// cleanups maps an in-flight *http.Request to its pendingCleanup, so a
+// requestTimeoutFilter can take over releasing dispatch's pooled objects
+// once the handler it abandoned actually finishes, without Request/Response
+// needing to carry anything extra.
+var cleanups sync.Map
+
+// registerCleanup records fn as the cleanup owed for raw once it's safe to
+// run, returning a function dispatch must call(instead of fn directly) when
+// its own filter chain call returns. That function runs fn immediately
+// unless a requestTimeoutFilter has already claimed it for its own orphaned
+// goroutine, in which case dispatch must not touch the pooled objects at all.
+func registerCleanup(raw *http.Request, fn func()) (release func()) {
+	c := &pendingCleanup{fn: fn}
+	cleanups.Store(raw, c)
+
+	return func() {
+		defer cleanups.Delete(raw)
+		if c.tryClaim() {
+			c.fn()
+		}
+	}
+}
+
+// tryClaim reports whether the caller is the first to claim this cleanup;
+// a plain sync.Once doesn't work here since dispatch's defer always runs
+// first(immediately after a timeout fires) and must be able to detect that
+// the filter already claimed responsibility instead of running fn itself.
+func (c *pendingCleanup) tryClaim() bool {
+	return atomic.CompareAndSwapInt32(&c.claimed, 0, 1)
+}
+
+// NewMaxInFlightFilter returns a Filter that bounds the number of requests
+// served concurrently to max; once reached, further requests get 503 instead
+// of being queued. ServerOption.MaxInFlight installs one globally, ahead of
+// every route's own filters; pass the result to Router to bound a single
+// route instead.
+func NewMaxInFlightFilter(max int) Filter {
+	return &maxInFlightFilter{sem: make(chan struct{}, max)}
+}
+
+func (*maxInFlightFilter) Init(Enviroment) error { return nil }
+func (*maxInFlightFilter) Destroy()              {}
+
+func (f *maxInFlightFilter) Filter(req Request, resp Response, chain FilterChain) {
+	select {
+	case f.sem <- struct{}{}:
+		defer func() { <-f.sem }()
+		chain(req, resp)
+	default:
+		resp.ReportStatus(http.StatusServiceUnavailable)
+	}
+}
+
+// NewRequestTimeoutFilter returns a Filter that reports 504 if the rest of
+// the chain hasn't finished within timeout. longRunning exempts matching
+// requests(e.g. websocket upgrades) from the deadline; nil defaults to
+// websocket.IsWebSocketRequest. ServerOption.RequestTimeout/LongRunningMatcher
+// install one globally; pass the result to Router to bound a single route
+// instead.
+//
+// Unlike net/http.TimeoutHandler, this can't discard writes the rest of the
+// chain makes after the deadline: Response is already built by the time a
+// Filter runs, so there's no ResponseWriter left to splice a discarding
+// wrapper into. A handler that keeps running past the timeout can still
+// write to resp after the 504 this filter already sent.
+func NewRequestTimeoutFilter(timeout time.Duration, longRunning func(*http.Request) bool) Filter {
+	if longRunning == nil {
+		longRunning = websocket.IsWebSocketRequest
+	}
+
+	return &requestTimeoutFilter{timeout: timeout, longRunning: longRunning}
+}
+
+func (*requestTimeoutFilter) Init(Enviroment) error { return nil }
+func (*requestTimeoutFilter) Destroy()              {}
+
+func (f *requestTimeoutFilter) Filter(req Request, resp Response, chain FilterChain) {
+	raw := req.Raw()
+	if f.timeout <= 0 || f.longRunning(raw) {
+		chain(req, resp)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(raw.Context(), f.timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		chain(req, resp)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		resp.ReportStatus(http.StatusGatewayTimeout)
+		// dispatch returns as soon as this filter does, but chain(req, resp)
+		// above is still running in the background; wait for it before
+		// recycling req/resp/filters out from under it.
+		if v, ok := cleanups.Load(raw); ok {
+			c := v.(*pendingCleanup)
+			if c.tryClaim() {
+				go func() {
+					<-done
+					c.fn()
+				}()
+			}
+		}
+	}
+}
+
+// builtinRootFilters decorates a RootFilters, prepending the always-on
+// filters built from ServerOption(MaxInFlight, RequestTimeout) ahead of
+// whatever the application registered, so the defaults run through the same
+// newFilterChain machinery as any other filter instead of being
+// special-cased in ServeHTTP.
+type builtinRootFilters struct {
+	RootFilters
+	builtins []Filter
+}
+
+func (b *builtinRootFilters) Filters(url *url.URL) []Filter {
+	return append(append([]Filter{}, b.builtins...), b.RootFilters.Filters(url)...)
+}
+
+func (b *builtinRootFilters) Init(env Enviroment) error {
+	for _, f := range b.builtins {
+		if err := f.Init(env); err != nil {
+			return err
+		}
+	}
+
+	return b.RootFilters.Init(env)
+}
+
+func (b *builtinRootFilters) Destroy() {
+	for _, f := range b.builtins {
+		f.Destroy()
+	}
+	b.RootFilters.Destroy()
+}
@@ -0,0 +1,76 @@
+package zerver
+
+import (
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRegisterCleanupRunsOnReleaseWhenUnclaimed(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+
+	var ran int32
+	release := registerCleanup(req, func() { atomic.AddInt32(&ran, 1) })
+	release()
+
+	if atomic.LoadInt32(&ran) != 1 {
+		t.Fatalf("ran = %d, want 1", ran)
+	}
+	if _, ok := cleanups.Load(req); ok {
+		t.Fatal("registerCleanup entry was not removed by release")
+	}
+}
+
+// TestRegisterCleanupDefersToEarlierClaimant exercises the exact race
+// requestTimeoutFilter and dispatch coordinate around: on a timeout, the
+// filter claims the cleanup before dispatch's own deferred release runs, so
+// release must skip running fn itself and leave it to whoever claimed it.
+func TestRegisterCleanupDefersToEarlierClaimant(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+
+	var ran int32
+	release := registerCleanup(req, func() { atomic.AddInt32(&ran, 1) })
+
+	v, ok := cleanups.Load(req)
+	if !ok {
+		t.Fatal("expected a pending cleanup to be registered")
+	}
+	c := v.(*pendingCleanup)
+	if !c.tryClaim() {
+		t.Fatal("expected the first claim to succeed")
+	}
+
+	// dispatch's defer always runs next on this path; it must not run fn a
+	// second time just because the chain call already returned
+	release()
+	if atomic.LoadInt32(&ran) != 0 {
+		t.Fatal("release ran cleanup after another goroutine already claimed it")
+	}
+
+	c.fn()
+	if atomic.LoadInt32(&ran) != 1 {
+		t.Fatalf("claimant's cleanup never ran: ran = %d", ran)
+	}
+}
+
+func TestPendingCleanupTryClaimOnlyOnce(t *testing.T) {
+	c := &pendingCleanup{fn: func() {}}
+
+	var wins int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c.tryClaim() {
+				atomic.AddInt32(&wins, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if wins != 1 {
+		t.Fatalf("wins = %d, want exactly 1 claimant", wins)
+	}
+}
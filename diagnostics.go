@@ -0,0 +1,113 @@
+package zerver
+
+import (
+	"context"
+	"crypto/tls"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// DiagnosticsOption configures Server.EnableDiagnostics
+type DiagnosticsOption struct {
+	// Addr the diagnostics server listens on, e.g. "localhost:6060". It must
+	// be set to something other than the public ListenAddr so profiling and
+	// metrics never get exposed on the public port.
+	Addr string
+	// PathPrefix in front of every diagnostics path, default "/debug"
+	PathPrefix string
+
+	// EnablePprof registers net/http/pprof under PathPrefix+"/pprof/"
+	EnablePprof bool
+	// EnableExpvar registers the expvar handler under PathPrefix+"/vars"
+	EnableExpvar bool
+	// EnableMetrics registers a Prometheus exposition endpoint under
+	// PathPrefix+"/metrics", fed by a collector wired into every
+	// non-websocket request
+	EnableMetrics bool
+
+	// TLSConfig, if set, serves diagnostics over TLS instead of plaintext
+	TLSConfig *tls.Config
+}
+
+func (o *DiagnosticsOption) init() {
+	if o.PathPrefix == "" {
+		o.PathPrefix = "/debug"
+	}
+}
+
+// EnableDiagnostics starts a separate *http.Server, on its own listener, that
+// serves profiling(pprof), expvar and/or Prometheus metrics endpoints per
+// opt. It's kept off the public ListenAddr on purpose: profiling data
+// shouldn't be reachable from wherever the application's users are. The
+// metrics endpoint is fed by a collector that instruments every request
+// ServeHTTP dispatches except websocket upgrades(serveWebSocket records no
+// metrics), keyed by the matched route pattern when the Handler
+// implements RoutePattern. Without that, requests are keyed by raw request
+// path, which is unbounded cardinality on dynamic paths(e.g. "/users/123",
+// "/users/124", ...) — implement RoutePattern on your Handler to bound it.
+func (s *Server) EnableDiagnostics(opt DiagnosticsOption) error {
+	opt.init()
+
+	mux := http.NewServeMux()
+	if opt.EnablePprof {
+		prefix := opt.PathPrefix + "/pprof/"
+		mux.HandleFunc(prefix, pprof.Index)
+		mux.HandleFunc(prefix+"cmdline", pprof.Cmdline)
+		mux.HandleFunc(prefix+"profile", pprof.Profile)
+		mux.HandleFunc(prefix+"symbol", pprof.Symbol)
+		mux.HandleFunc(prefix+"trace", pprof.Trace)
+	}
+	if opt.EnableExpvar {
+		mux.Handle(opt.PathPrefix+"/vars", expvar.Handler())
+	}
+	if opt.EnableMetrics {
+		if s.metrics == nil {
+			s.metrics = newMetricsCollector()
+		}
+		mux.HandleFunc(opt.PathPrefix+"/metrics", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			s.warnLog(ignoreN(s.metrics.WriteTo(w)))
+		})
+	}
+
+	ln, err := net.Listen("tcp", opt.Addr)
+	if err != nil {
+		return err
+	}
+	if opt.TLSConfig != nil {
+		ln = tls.NewListener(ln, opt.TLSConfig)
+	}
+
+	s.diagSrv = &http.Server{Handler: mux}
+	go func() {
+		if err := s.diagSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.warnLog(err)
+		}
+	}()
+
+	return nil
+}
+
+// ignoreN discards the byte count io.WriterTo.WriteTo returns, keeping only
+// the error for warnLog
+func ignoreN(_ int64, err error) error {
+	return err
+}
+
+func (s *Server) destroyDiagnostics(timeout time.Duration) {
+	if s.diagSrv == nil {
+		return
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	s.warnLog(s.diagSrv.Shutdown(ctx))
+}
@@ -0,0 +1,65 @@
+package zerver
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestServerEnableHTTP2NegotiatesALPN(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeSelfSignedCert(t, dir, "localhost")
+
+	s := NewServer()
+	started := make(chan error, 1)
+	go func() {
+		started <- s.Start(&ServerOption{
+			ListenAddr:  "127.0.0.1:0",
+			CertFile:    certPath,
+			KeyFile:     keyPath,
+			EnableHTTP2: true,
+		})
+	}()
+	defer func() {
+		s.Destroy(time.Second)
+		<-started
+	}()
+
+	ln := waitForListener(t, s)
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial: %v", err)
+	}
+	defer conn.Close()
+
+	if got := conn.ConnectionState().NegotiatedProtocol; got != "h2" {
+		t.Fatalf("NegotiatedProtocol = %q, want h2", got)
+	}
+}
+
+func TestPrependH2(t *testing.T) {
+	cases := []struct {
+		in   []string
+		want []string
+	}{
+		{nil, []string{"h2"}},
+		{[]string{"http/1.1"}, []string{"h2", "http/1.1"}},
+		{[]string{"h2", "http/1.1"}, []string{"h2", "http/1.1"}},
+	}
+
+	for _, c := range cases {
+		got := prependH2(c.in)
+		if len(got) != len(c.want) {
+			t.Fatalf("prependH2(%v) = %v, want %v", c.in, got, c.want)
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Fatalf("prependH2(%v) = %v, want %v", c.in, got, c.want)
+			}
+		}
+	}
+}
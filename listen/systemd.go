@@ -0,0 +1,77 @@
+package listen
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/xiazemin/zerver"
+)
+
+const systemdListenFDsStart = 3
+
+// SystemdListener returns a ListenerFactory that adopts a socket handed over
+// by a socket-activation supervisor (systemd) instead of binding its own, per
+// sd_listen_fds(3): LISTEN_PID must match the current process and LISTEN_FDS
+// gives the number of inherited fds starting at fd 3. When the supervisor
+// also sets LISTEN_FDNAMES (colon-separated, one per fd), name selects the
+// matching fd; leave name empty when only a single socket is passed. This
+// enables zero-downtime restarts where the supervisor keeps the listening
+// socket open across an exec of the new binary.
+func SystemdListener(name string) zerver.ListenerFactory {
+	return func(opt *zerver.ServerOption) (net.Listener, error) {
+		nfds, err := systemdNumFDs()
+		if err != nil {
+			return nil, err
+		}
+
+		idx := 0
+		if name != "" {
+			names := os.Getenv("LISTEN_FDNAMES")
+			if names == "" {
+				return nil, fmt.Errorf("zerver/listen: socket named %q requested but LISTEN_FDNAMES was not set", name)
+			}
+
+			idx = -1
+			for i, n := range strings.Split(names, ":") {
+				if n == name {
+					idx = i
+					break
+				}
+			}
+			if idx == -1 {
+				return nil, fmt.Errorf("zerver/listen: no systemd socket named %q", name)
+			}
+		}
+
+		if idx >= nfds {
+			return nil, fmt.Errorf("zerver/listen: systemd passed %d fd(s), wanted index %d", nfds, idx)
+		}
+
+		fd := uintptr(systemdListenFDsStart + idx)
+		file := os.NewFile(fd, fmt.Sprintf("systemd-socket-%d", fd))
+		ln, err := net.FileListener(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		return ln, nil
+	}
+}
+
+func systemdNumFDs() (int, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return 0, fmt.Errorf("zerver/listen: no systemd socket activation for this process")
+	}
+
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds < 1 {
+		return 0, fmt.Errorf("zerver/listen: LISTEN_FDS not set or empty")
+	}
+
+	return nfds, nil
+}
@@ -0,0 +1,57 @@
+package listen
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/xiazemin/zerver"
+)
+
+func withSystemdEnv(t *testing.T, fds int, names string) {
+	t.Helper()
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(fds))
+	if names == "" {
+		os.Unsetenv("LISTEN_FDNAMES")
+	} else {
+		t.Setenv("LISTEN_FDNAMES", names)
+	}
+}
+
+func TestSystemdListenerNamedSocketWithoutFDNamesErrors(t *testing.T) {
+	withSystemdEnv(t, 1, "")
+
+	_, err := SystemdListener("admin")(&zerver.ServerOption{})
+	if err == nil {
+		t.Fatal("expected an error requesting a named socket with LISTEN_FDNAMES unset, got nil")
+	}
+}
+
+func TestSystemdListenerUnnamedDefaultsToFirstFD(t *testing.T) {
+	withSystemdEnv(t, 1, "")
+
+	_, err := SystemdListener("")(&zerver.ServerOption{})
+	// fd 3 isn't actually open in the test process, so this still fails, but
+	// it must fail on the fd, not on missing socket-activation env
+	if err == nil {
+		t.Fatal("expected an fd error since fd 3 isn't open in tests")
+	}
+	if err.Error() == "" {
+		t.Fatal("expected a non-empty error")
+	}
+	if strings.HasPrefix(err.Error(), "zerver/listen:") {
+		t.Fatalf("expected an fd error, got a socket-activation env error: %v", err)
+	}
+}
+
+func TestSystemdNumFDsRejectsZeroFDs(t *testing.T) {
+	withSystemdEnv(t, 0, "")
+
+	_, err := systemdNumFDs()
+	if err == nil {
+		t.Fatal("expected LISTEN_FDS<1 to error")
+	}
+}
@@ -0,0 +1,36 @@
+// Package listen provides zerver.ListenerFactory implementations beyond the
+// default TCP listener, for Unix-socket admin endpoints and systemd
+// socket-activation.
+package listen
+
+import (
+	"net"
+	"os"
+
+	"github.com/xiazemin/zerver"
+)
+
+// UnixListener returns a ListenerFactory that listens on the given unix
+// socket path instead of ServerOption.ListenAddr, chmod'ing it to mode once
+// bound. Any existing socket file at path is removed first, since a stale
+// file from an unclean shutdown would otherwise make net.Listen fail with
+// "address already in use".
+func UnixListener(path string, mode os.FileMode) zerver.ListenerFactory {
+	return func(opt *zerver.ServerOption) (net.Listener, error) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+
+		return ln, nil
+	}
+}
@@ -0,0 +1,48 @@
+package listen
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xiazemin/zerver"
+)
+
+func TestUnixListenerBindsAndChmods(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zerver.sock")
+
+	ln, err := UnixListener(path, 0600)(&zerver.ServerOption{})
+	if err != nil {
+		t.Fatalf("UnixListener: %v", err)
+	}
+	defer ln.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat(%q): %v", path, err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("socket mode = %o, want %o", perm, 0600)
+	}
+}
+
+func TestUnixListenerRemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zerver.sock")
+
+	first, err := UnixListener(path, 0600)(&zerver.ServerOption{})
+	if err != nil {
+		t.Fatalf("UnixListener(first): %v", err)
+	}
+	first.(*net.UnixListener).SetUnlinkOnClose(false)
+	first.Close()
+
+	// first.Close() doesn't remove the socket file, mimicking an unclean
+	// shutdown; a second bind must still succeed instead of failing with
+	// "address already in use"
+	second, err := UnixListener(path, 0600)(&zerver.ServerOption{})
+	if err != nil {
+		t.Fatalf("UnixListener(second) on stale socket: %v", err)
+	}
+	second.Close()
+}
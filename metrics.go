@@ -0,0 +1,196 @@
+package zerver
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RoutePattern is implemented by a Handler that knows the route pattern it
+// was registered under(e.g. "/users/:id"), letting the metrics collector key
+// on that instead of the raw, unbounded-cardinality request path. This is
+// opt-in: nothing in zerver's own Router/Handler implements it, so metrics
+// are keyed by raw request path(unbounded cardinality on dynamic paths)
+// unless your own Handler implements RoutePattern too.
+type RoutePattern interface {
+	Pattern() string
+}
+
+// routePattern returns the best label available for metrics: the handler's
+// declared Pattern() if it implements RoutePattern, "-" when no handler
+// matched, otherwise the literal request path, see RoutePattern.
+func routePattern(url *url.URL, handler Handler) string {
+	if rp, ok := handler.(RoutePattern); ok {
+		return rp.Pattern()
+	}
+	if handler == nil {
+		return "-"
+	}
+
+	return url.Path
+}
+
+// statusResponseWriter records the status code a handler responds with, so
+// the metrics collector can count it without Response exposing one itself
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// latencyBuckets are the histogram bucket upper bounds, in seconds, used for
+// per-route request latency, modeled after the Prometheus client defaults
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// routeStats holds the counters for a single route pattern
+type routeStats struct {
+	requests int64 // atomic
+	inFlight int64 // atomic
+	buckets  []int64
+	sum      uint64   // atomic, float64 bits, total latency seconds
+	byStatus sync.Map // status code(int) -> *int64
+}
+
+func newRouteStats() *routeStats {
+	return &routeStats{buckets: make([]int64, len(latencyBuckets)+1)}
+}
+
+func (r *routeStats) observe(status int, d time.Duration) {
+	atomic.AddInt64(&r.requests, 1)
+
+	secs := d.Seconds()
+	idx := sort.SearchFloat64s(latencyBuckets, secs)
+	atomic.AddInt64(&r.buckets[idx], 1)
+	addFloat64(&r.sum, secs)
+
+	v, _ := r.byStatus.LoadOrStore(status, new(int64))
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+func addFloat64(bits *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(bits, old, updated) {
+			return
+		}
+	}
+}
+
+// metricsCollector instruments serveHTTP per route label, keeping request
+// count, in-flight gauge, latency histogram and status counters for each
+// label routePattern yields. The number of labels is bounded by the number
+// of route patterns only for handlers implementing RoutePattern; any other
+// handler adds one label per distinct raw request path.
+type metricsCollector struct {
+	routes sync.Map // route pattern(string) -> *routeStats
+}
+
+func newMetricsCollector() *metricsCollector {
+	return &metricsCollector{}
+}
+
+func (c *metricsCollector) statsFor(route string) *routeStats {
+	v, _ := c.routes.LoadOrStore(route, newRouteStats())
+	return v.(*routeStats)
+}
+
+// track wraps a single request/response cycle for route, returning a done
+// func to call once the response has been written
+func (c *metricsCollector) track(route string) (done func(status int)) {
+	stats := c.statsFor(route)
+	atomic.AddInt64(&stats.inFlight, 1)
+	start := time.Now()
+
+	return func(status int) {
+		atomic.AddInt64(&stats.inFlight, -1)
+		stats.observe(status, time.Since(start))
+	}
+}
+
+// WriteTo renders all collected metrics in Prometheus text exposition format
+func (c *metricsCollector) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+
+	write := func(format string, args ...interface{}) error {
+		n, err := fmt.Fprintf(w, format, args...)
+		written += int64(n)
+		return err
+	}
+
+	if err := write("# HELP zerver_http_requests_total Total number of HTTP requests by route.\n# TYPE zerver_http_requests_total counter\n"); err != nil {
+		return written, err
+	}
+	if err := write("# HELP zerver_http_in_flight_requests Requests currently being served by route.\n# TYPE zerver_http_in_flight_requests gauge\n"); err != nil {
+		return written, err
+	}
+	if err := write("# HELP zerver_http_request_duration_seconds Request latency by route.\n# TYPE zerver_http_request_duration_seconds histogram\n"); err != nil {
+		return written, err
+	}
+	if err := write("# HELP zerver_http_responses_total Responses by route and status code.\n# TYPE zerver_http_responses_total counter\n"); err != nil {
+		return written, err
+	}
+
+	var routes []string
+	c.routes.Range(func(k, _ interface{}) bool {
+		routes = append(routes, k.(string))
+		return true
+	})
+	sort.Strings(routes)
+
+	for _, route := range routes {
+		v, _ := c.routes.Load(route)
+		s := v.(*routeStats)
+
+		if err := write("zerver_http_requests_total{route=%q} %d\n", route, atomic.LoadInt64(&s.requests)); err != nil {
+			return written, err
+		}
+		if err := write("zerver_http_in_flight_requests{route=%q} %d\n", route, atomic.LoadInt64(&s.inFlight)); err != nil {
+			return written, err
+		}
+
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += atomic.LoadInt64(&s.buckets[i])
+			if err := write("zerver_http_request_duration_seconds_bucket{route=%q,le=%q} %d\n", route, strconv.FormatFloat(bound, 'f', -1, 64), cumulative); err != nil {
+				return written, err
+			}
+		}
+		cumulative += atomic.LoadInt64(&s.buckets[len(latencyBuckets)])
+		if err := write("zerver_http_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, cumulative); err != nil {
+			return written, err
+		}
+		if err := write("zerver_http_request_duration_seconds_sum{route=%q} %s\n", route, strconv.FormatFloat(math.Float64frombits(atomic.LoadUint64(&s.sum)), 'f', -1, 64)); err != nil {
+			return written, err
+		}
+		if err := write("zerver_http_request_duration_seconds_count{route=%q} %d\n", route, cumulative); err != nil {
+			return written, err
+		}
+
+		var statuses []int
+		s.byStatus.Range(func(k, _ interface{}) bool {
+			statuses = append(statuses, k.(int))
+			return true
+		})
+		sort.Ints(statuses)
+		for _, status := range statuses {
+			v, _ := s.byStatus.Load(status)
+			if err := write("zerver_http_responses_total{route=%q,status=%q} %d\n", route, strconv.Itoa(status), atomic.LoadInt64(v.(*int64))); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,52 @@
+package zerver
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoutePatternFallback(t *testing.T) {
+	u := &url.URL{Path: "/users/123"}
+
+	if got := routePattern(u, nil); got != "-" {
+		t.Errorf("routePattern(nil) = %q, want %q", got, "-")
+	}
+}
+
+func TestMetricsCollectorWriteTo(t *testing.T) {
+	c := newMetricsCollector()
+
+	done := c.track("/users/:id")
+	done(200)
+
+	done = c.track("/users/:id")
+	done(500)
+
+	var buf strings.Builder
+	if _, err := c.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		`zerver_http_requests_total{route="/users/:id"} 2`,
+		`zerver_http_responses_total{route="/users/:id",status="200"} 1`,
+		`zerver_http_responses_total{route="/users/:id",status="500"} 1`,
+		`zerver_http_in_flight_requests{route="/users/:id"} 0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("WriteTo output missing %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestRouteStatsObserve(t *testing.T) {
+	stats := newRouteStats()
+	stats.observe(200, 50*time.Millisecond)
+
+	if stats.requests != 1 {
+		t.Errorf("requests = %d, want 1", stats.requests)
+	}
+}
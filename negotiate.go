@@ -0,0 +1,182 @@
+package zerver
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cosiner/ygo/resource"
+)
+
+// acceptRange is one parsed entry of an Accept header, e.g. "text/html;q=0.9"
+type acceptRange struct {
+	typ, subtype string
+	q            float64
+}
+
+// matches reports whether contentType(possibly with its own ";charset=..."
+// params, which are ignored here) satisfies this accept range, wildcards
+// included
+func (a acceptRange) matches(contentType string) bool {
+	mime := contentType
+	if i := strings.IndexByte(mime, ';'); i >= 0 {
+		mime = mime[:i]
+	}
+
+	typ, subtype := mime, "*"
+	if i := strings.IndexByte(mime, '/'); i >= 0 {
+		typ, subtype = mime[:i], mime[i+1:]
+	}
+
+	if a.typ != "*" && a.typ != typ {
+		return false
+	}
+
+	return a.subtype == "*" || a.subtype == subtype
+}
+
+// parseAccept parses an Accept header value into its ranges, most preferred
+// first(highest q, ties keep header order)
+func parseAccept(header string) []acceptRange {
+	parts := strings.Split(header, ",")
+	ranges := make([]acceptRange, 0, len(parts))
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		segs := strings.Split(part, ";")
+		mime := strings.TrimSpace(segs[0])
+		typ, subtype := mime, "*"
+		if i := strings.IndexByte(mime, '/'); i >= 0 {
+			typ, subtype = mime[:i], mime[i+1:]
+		}
+
+		q := 1.0
+		for _, param := range segs[1:] {
+			param = strings.TrimSpace(param)
+			if v, ok := cutPrefix(param, "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+
+		ranges = append(ranges, acceptRange{typ: typ, subtype: subtype, q: q})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	return ranges
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return "", false
+	}
+
+	return s[len(prefix):], true
+}
+
+// notAcceptableError is the type of ErrNotAcceptable, which Server.Negotiate
+// returns when none of the server's registered resources satisfy the
+// client's Accept header
+type notAcceptableError string
+
+func (e notAcceptableError) Error() string { return string(e) }
+
+// ErrNotAcceptable is the error Negotiate returns when no registered
+// resource satisfies the client's Accept header
+const ErrNotAcceptable = notAcceptableError("zerver: no acceptable representation for Accept header")
+
+// Negotiate picks the response resource.Resource and Content-Type that best
+// satisfy accept(the raw value of the request's Accept header), preferring
+// higher q-values and falling back to ServerOption.ContentType when accept is
+// empty or "*/*". It returns ErrNotAcceptable if nothing registered in
+// ResMaster.Resources can satisfy accept.
+func (s *Server) Negotiate(accept string) (resource.Resource, string, error) {
+	accept = strings.TrimSpace(accept)
+	if accept == "" || accept == "*/*" {
+		if s.contentType == _CONTENTTYPE_DISABLE {
+			return nil, _CONTENTTYPE_DISABLE, nil
+		}
+
+		return s.ResMaster.Resource(s.contentType), s.contentType, nil
+	}
+
+	contentTypes := make([]string, 0, len(s.ResMaster.Resources))
+	for contentType := range s.ResMaster.Resources {
+		contentTypes = append(contentTypes, contentType)
+	}
+	sort.Strings(contentTypes)
+
+	for _, rng := range parseAccept(accept) {
+		if rng.q <= 0 {
+			continue // q=0 means explicitly not acceptable, RFC 7231 5.3.1
+		}
+
+		for _, contentType := range contentTypes {
+			if rng.matches(contentType) {
+				return s.ResMaster.Resources[contentType], contentType, nil
+			}
+		}
+	}
+
+	return nil, "", ErrNotAcceptable
+}
+
+// acceptsCharset reports whether header(the raw Accept-Charset value) allows
+// charset. An empty header accepts everything, as does "*" with a nonzero q.
+func acceptsCharset(header, charset string) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return true
+	}
+
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		segs := strings.Split(part, ";")
+		name := strings.TrimSpace(segs[0])
+		if !strings.EqualFold(name, charset) && name != "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range segs[1:] {
+			if v, ok := cutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiateResponse resolves the resource.Resource and Content-Type to
+// respond with for request, honoring ServerOption.DisableNegotiation. It
+// reports http.StatusNotAcceptable through ok=false when content negotiation
+// fails, either because Accept can't be satisfied or Accept-Charset rejects
+// the server's charset.
+func (s *Server) negotiateResponse(request *http.Request, fallback resource.Resource) (res resource.Resource, contentType string, ok bool) {
+	if s.disableNegotiation {
+		return fallback, s.contentType, true
+	}
+
+	res, contentType, err := s.Negotiate(request.Header.Get("Accept"))
+	if err != nil {
+		return nil, "", false
+	}
+
+	if contentType != _CONTENTTYPE_DISABLE && !acceptsCharset(request.Header.Get("Accept-Charset"), "utf-8") {
+		return nil, "", false
+	}
+
+	return res, contentType, true
+}
@@ -0,0 +1,73 @@
+package zerver
+
+import (
+	"testing"
+
+	"github.com/cosiner/ygo/resource"
+)
+
+func TestParseAccept(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []acceptRange
+	}{
+		{"", nil},
+		{"*/*", []acceptRange{{typ: "*", subtype: "*", q: 1}}},
+		{"application/json", []acceptRange{{typ: "application", subtype: "json", q: 1}}},
+		{
+			"text/html;q=0.8, application/json;q=0.9",
+			[]acceptRange{
+				{typ: "application", subtype: "json", q: 0.9},
+				{typ: "text", subtype: "html", q: 0.8},
+			},
+		},
+		{
+			"application/json;q=0",
+			[]acceptRange{{typ: "application", subtype: "json", q: 0}},
+		},
+	}
+
+	for _, tt := range tests {
+		got := parseAccept(tt.header)
+		if len(got) != len(tt.want) {
+			t.Fatalf("parseAccept(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("parseAccept(%q)[%d] = %+v, want %+v", tt.header, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestAcceptsCharset(t *testing.T) {
+	tests := []struct {
+		header  string
+		charset string
+		want    bool
+	}{
+		{"", "utf-8", true},
+		{"*", "utf-8", true},
+		{"utf-8", "utf-8", true},
+		{"UTF-8", "utf-8", true},
+		{"utf-8;q=0", "utf-8", false},
+		{"iso-8859-1", "utf-8", false},
+		{"iso-8859-1, utf-8;q=0.5", "utf-8", true},
+	}
+
+	for _, tt := range tests {
+		if got := acceptsCharset(tt.header, tt.charset); got != tt.want {
+			t.Errorf("acceptsCharset(%q, %q) = %v, want %v", tt.header, tt.charset, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateRejectsZeroQ(t *testing.T) {
+	s := NewServer()
+	s.ResMaster.DefUse(resource.RES_JSON, resource.JSON{})
+
+	_, _, err := s.Negotiate("application/json;q=0")
+	if err != ErrNotAcceptable {
+		t.Fatalf("Negotiate with q=0 = %v, want ErrNotAcceptable", err)
+	}
+}
@@ -1,22 +1,26 @@
 package zerver
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/cosiner/gohper/attrs"
-	"github.com/cosiner/gohper/crypto/tls2"
 	"github.com/cosiner/gohper/defval"
 	"github.com/cosiner/gohper/termcolor"
 	"github.com/cosiner/ygo/resource"
 	websocket "github.com/cosiner/zerver_websocket"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -59,10 +63,55 @@ type (
 		CAs []string
 		// ssl config, default disable tls
 		CertFile, KeyFile string
-		// if not nil, cert and key will be ignored
+		// additional cert/key pairs for SNI multi-cert serving, merged with
+		// CertFile/KeyFile when both are set. Every pair is reloaded from
+		// disk automatically when its file's mtime changes, or on demand via
+		// Server.ReloadTLS, so rotating a certificate doesn't need a restart
+		Certificates []CertPair
+		// if not nil, cert/key/Certificates are ignored and this is used
+		// instead; only its NextProtos is adjusted("h2" prepended when
+		// EnableHTTP2, "http/1.1" when empty otherwise)
 		TLSConfig *tls.Config
+		// Autocert, if set(and TLSConfig is not), fetches and renews
+		// certificates via ACME instead of reading them from disk
+		Autocert *AutocertConfig
+
+		// EnableHTTP2 negotiates HTTP/2 over TLS via ALPN, default disabled(http/1.1 only)
+		EnableHTTP2 bool
+		// HTTP2Config tunes the golang.org/x/net/http2 server, optional,
+		// only meaningful when EnableHTTP2 is true
+		HTTP2Config *http2.Server
+
+		// MaxInFlight bounds the number of requests served concurrently,
+		// default 0(unlimited), by installing NewMaxInFlightFilter as a
+		// root filter. Once reached, further requests get 503 instead of
+		// being queued
+		MaxInFlight int
+		// RequestTimeout aborts a request with 504 if its handler hasn't
+		// finished within this duration, default 0(disabled), by installing
+		// NewRequestTimeoutFilter as a root filter
+		RequestTimeout time.Duration
+		// LongRunningMatcher decides whether a request is exempt from
+		// RequestTimeout, default matches websocket upgrades only
+		LongRunningMatcher func(*http.Request) bool
+
+		// DisableNegotiation turns off Accept-based content negotiation and
+		// restores the old behavior of always responding with ContentType,
+		// default false(negotiation enabled)
+		DisableNegotiation bool
+
+		// ListenerFactory, if non-nil, fully replaces the built-in
+		// net.Listen("tcp", ListenAddr)+tcpKeepAliveListener path, e.g. to
+		// listen on a unix socket or adopt a systemd-activated fd, see the
+		// zerver/listen subpackage. TLS, when configured, is still wrapped
+		// on top of the returned listener.
+		ListenerFactory ListenerFactory
 	}
 
+	// ListenerFactory builds the net.Listener a Server accepts connections on,
+	// see ServerOption.ListenerFactory
+	ListenerFactory func(opt *ServerOption) (net.Listener, error)
+
 	// Server represent a web server
 	Server struct {
 		Router
@@ -75,9 +124,22 @@ type (
 		checker     websocket.HandshakeChecker
 		contentType string // default content type
 
-		listener    net.Listener
-		state       int32          // destroy or normal running
-		activeConns sync.WaitGroup // connections in service, don't include hijacked and websocket connections
+		// srvMu guards listener/srv: Start(running on the main goroutine)
+		// writes them once listening succeeds, while Destroy(typically
+		// called from Run's signal-handling goroutine) reads them
+		// concurrently, see Run
+		srvMu    sync.Mutex
+		listener net.Listener
+		srv      *http.Server
+		state    int32 // destroy or normal running
+
+		disableNegotiation bool
+
+		metrics *metricsCollector // nil unless EnableDiagnostics(EnableMetrics: true) was called
+		diagSrv *http.Server      // diagnostics server, nil unless EnableDiagnostics was called
+
+		certMgr *certManager // nil unless started with ServerOption.Certificates/CertFile
+		acmeSrv *http.Server // ACME HTTP-01 challenge server, nil unless ServerOption.Autocert was used
 	}
 
 	// HeaderChecker is a http header checker, it accept a function which can get
@@ -163,6 +225,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, request *http.Request) {
 		request.URL.Path = path[:l-1]
 	}
 
+	// websocket only upgrades over HTTP/1.1, h2 requests never match this check
 	if websocket.IsWebSocketRequest(request) {
 		s.serveWebSocket(w, request)
 	} else {
@@ -190,30 +253,62 @@ func (s *Server) serveHTTP(w http.ResponseWriter, request *http.Request) {
 	url.Host = request.Host
 	handler, indexer, filters := s.MatchHandlerFilters(url)
 
-	reqEnv := newRequestEnvFromPool()
-	res := s.ResMaster.Resource(reqEnv.req.ContentType())
-	req := reqEnv.req.init(s, res, request, indexer)
-	resp := reqEnv.resp.init(s, res, w)
-	if s.contentType != _CONTENTTYPE_DISABLE {
-		resp.SetContentType(s.contentType)
+	s.dispatch(w, request, url, handler, indexer, filters)
+}
+
+// dispatch runs the matched handler and filters for a single request. When a
+// NewRequestTimeoutFilter filter is installed(via RootFilters/Router) and fires, the
+// filter chain call below returns as soon as the 504 is reported, while the
+// abandoned handler goroutine keeps running against req/resp in the
+// background; releasing req/resp/filters back to their pools here would
+// then race that goroutine. registerCleanup resolves this by letting
+// whichever of dispatch or the filter finishes last actually perform the
+// release, see builtin_filters.go. The deferred metrics done() call isn't
+// affected by any of this: it still fires the moment the filter chain call
+// below returns, so it always records the true final status(including a
+// filter's own 504) without waiting on the abandoned goroutine either.
+func (s *Server) dispatch(w http.ResponseWriter, request *http.Request, url *url.URL, handler Handler, indexer Indexer, filters Filters) {
+	if s.metrics != nil {
+		done := s.metrics.track(routePattern(url, handler))
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		w = sw
+		defer func() { done(sw.status) }()
 	}
 
+	reqEnv := newRequestEnvFromPool()
+	reqRes := s.ResMaster.Resource(reqEnv.req.ContentType())
+	req := reqEnv.req.init(s, reqRes, request, indexer)
+
+	respRes, contentType, negotiated := s.negotiateResponse(request, reqRes)
+	resp := reqEnv.resp.init(s, respRes, w)
+
+	release := registerCleanup(request, func() {
+		s.warnLog(req.destroy())
+		s.warnLog(resp.destroy())
+
+		recycleRequestEnv(reqEnv)
+		recycleFilters(filters)
+	})
+	defer release()
+
 	var chain FilterChain
-	if handler == nil {
-		resp.ReportNotFound()
-	} else if chain = FilterChain(handler.Handler(req.Method())); chain == nil {
-		resp.ReportMethodNotAllowed()
+	if !negotiated {
+		resp.ReportStatus(http.StatusNotAcceptable)
+	} else {
+		if contentType != _CONTENTTYPE_DISABLE {
+			resp.SetContentType(contentType)
+		}
+
+		if handler == nil {
+			resp.ReportNotFound()
+		} else if chain = FilterChain(handler.Handler(req.Method())); chain == nil {
+			resp.ReportMethodNotAllowed()
+		}
 	}
 
 	newFilterChain(s.RootFilters.Filters(url),
 		newFilterChain(filters, chain),
 	)(req, resp)
-
-	s.warnLog(req.destroy())
-	s.warnLog(resp.destroy())
-
-	recycleRequestEnv(reqEnv)
-	recycleFilters(filters)
 }
 
 func (o *ServerOption) init() {
@@ -238,6 +333,20 @@ func (s *Server) config(o *ServerOption) {
 	s.contentType = o.ContentType
 	s.checker = websocket.HeaderChecker(o.WebSocketChecker).HandshakeCheck
 
+	var builtins []Filter
+	if o.MaxInFlight > 0 {
+		log.Print(termcolor.Green.Sprint("MaxInFlight:", o.MaxInFlight))
+		builtins = append(builtins, NewMaxInFlightFilter(o.MaxInFlight))
+	}
+	if o.RequestTimeout > 0 {
+		log.Print(termcolor.Green.Sprint("RequestTimeout:", o.RequestTimeout))
+		builtins = append(builtins, NewRequestTimeoutFilter(o.RequestTimeout, o.LongRunningMatcher))
+	}
+	if len(builtins) > 0 {
+		s.RootFilters = &builtinRootFilters{RootFilters: s.RootFilters, builtins: builtins}
+	}
+	s.disableNegotiation = o.DisableNegotiation
+
 	if len(s.ResMaster.Resources) == 0 {
 		s.ResMaster.DefUse(resource.RES_JSON, resource.JSON{})
 	}
@@ -292,6 +401,22 @@ func (s *Server) warnLog(err error) {
 	}
 }
 
+// setSrv records the listener/http.Server Start is about to serve on, under
+// srvMu so Destroy can safely read them from another goroutine(see Run)
+func (s *Server) setSrv(l net.Listener, srv *http.Server) {
+	s.srvMu.Lock()
+	s.listener = l
+	s.srv = srv
+	s.srvMu.Unlock()
+}
+
+// getSrv reads back what setSrv last recorded, nil until Start gets there
+func (s *Server) getSrv() (net.Listener, *http.Server) {
+	s.srvMu.Lock()
+	defer s.srvMu.Unlock()
+	return s.listener, s.srv
+}
+
 // Start server as http server, if opt is nil, use default configurations
 func (s *Server) Start(opt *ServerOption) error {
 	if opt == nil {
@@ -301,19 +426,62 @@ func (s *Server) Start(opt *ServerOption) error {
 
 	l, err := s.listen(opt)
 	if err == nil {
-		s.listener = l
 		srv := &http.Server{
 			ReadTimeout:  opt.ReadTimeout,
 			WriteTimeout: opt.WriteTimeout,
 			Handler:      s,
-			ConnState:    s.connStateHook,
 		}
-		err = srv.Serve(l)
+		if opt.EnableHTTP2 {
+			h2conf := opt.HTTP2Config
+			if h2conf == nil {
+				h2conf = &http2.Server{}
+			}
+			if err = http2.ConfigureServer(srv, h2conf); err != nil {
+				s.warnLog(l.Close())
+			}
+		}
+		if err == nil {
+			s.setSrv(l, srv)
+			err = srv.Serve(l)
+			if err == http.ErrServerClosed {
+				err = nil
+			}
+		}
 	}
 
 	return err
 }
 
+// Run starts the server like Start, and additionally installs signal
+// handlers: the given signals (SIGINT, SIGTERM if none given) call Destroy
+// with a 15 second timeout, giving in-flight requests a chance to drain
+// before the process exits, and SIGHUP calls ReloadTLS to pick up rotated
+// certificates without restarting. It blocks until the server stops.
+func (s *Server) Run(opt *ServerOption, signals ...os.Signal) error {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	go func() {
+		<-c
+		log.Print(termcolor.Green.Sprint("received shutdown signal, draining connections"))
+		s.Destroy(15 * time.Second)
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Print(termcolor.Green.Sprint("received SIGHUP, reloading TLS certificates"))
+			s.warnLog(s.ReloadTLS())
+		}
+	}()
+
+	return s.Start(opt)
+}
+
 // from net/http/server/go
 type tcpKeepAliveListener struct {
 	*net.TCPListener
@@ -334,34 +502,31 @@ func (ln *tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 }
 
 func (s *Server) listen(opt *ServerOption) (net.Listener, error) {
-	ln, err := net.Listen("tcp", opt.ListenAddr)
-	if err == nil {
-		ln = &tcpKeepAliveListener{
-			TCPListener: ln.(*net.TCPListener),
-			AlivePeriod: opt.KeepAlivePeriod,
+	var ln net.Listener
+	var err error
+	if opt.ListenerFactory != nil {
+		ln, err = opt.ListenerFactory(opt)
+	} else {
+		ln, err = net.Listen("tcp", opt.ListenAddr)
+		if err == nil {
+			ln = &tcpKeepAliveListener{
+				TCPListener: ln.(*net.TCPListener),
+				AlivePeriod: opt.KeepAlivePeriod,
+			}
 		}
+	}
 
-		if opt.TLSConfig != nil {
-			ln = tls.NewListener(ln, opt.TLSConfig)
-		} else if opt.CertFile != "" {
-			// from net/http/server.go.ListenAndServeTLS
-			tc := &tls.Config{
-				NextProtos:   []string{"http/1.1"},
-				Certificates: make([]tls.Certificate, 1),
+	if err == nil {
+		var tc *tls.Config
+		tc, s.certMgr, err = s.buildTLSConfig(opt)
+		if err == nil && tc != nil {
+			if opt.EnableHTTP2 {
+				tc.NextProtos = prependH2(tc.NextProtos)
+			} else if len(tc.NextProtos) == 0 {
+				tc.NextProtos = []string{"http/1.1"}
 			}
 
-			tc.Certificates[0], err = tls.LoadX509KeyPair(opt.CertFile, opt.KeyFile)
-			if err == nil {
-				if opt.CAs != nil {
-					tc.ClientCAs, err = tls2.CAPool(opt.CAs...)
-					if err == nil {
-						tc.ClientAuth = tls.RequireAndVerifyClientCert
-					}
-				}
-				if err == nil {
-					ln = tls.NewListener(ln, tc)
-				}
-			}
+			ln = tls.NewListener(ln, tc)
 		}
 	}
 
@@ -373,23 +538,16 @@ func (s *Server) listen(opt *ServerOption) (net.Listener, error) {
 	return ln, err
 }
 
-func (s *Server) connStateHook(conn net.Conn, state http.ConnState) {
-	switch state {
-	case http.StateActive:
-		if atomic.LoadInt32(&s.state) == _NORMAL {
-			s.activeConns.Add(1)
-		} else {
-			// previous idle connections before call server.Destroy() becomes active, directly close it
-			s.warnLog(conn.Close())
+// prependH2 puts "h2" first in the ALPN protocol list so it's preferred over
+// http/1.1 during negotiation, without duplicating it if already present.
+func prependH2(protos []string) []string {
+	for _, p := range protos {
+		if p == "h2" {
+			return protos
 		}
-	case http.StateIdle:
-		if atomic.LoadInt32(&s.state) == _DESTROYED {
-			s.warnLog(conn.Close())
-		}
-		s.activeConns.Done()
-	case http.StateHijacked:
-		s.activeConns.Done()
 	}
+
+	return append([]string{"h2"}, protos...)
 }
 
 func panicOnInit(err error) {
@@ -398,30 +556,42 @@ func panicOnInit(err error) {
 	}
 }
 
-// Destroy server, release all resources, if destroyed, server can't be reused
-// It only wait for managed connections, hijacked/websocket connections will not waiting
-// if timeout or server already destroyed, false was returned
+// Destroy server, release all resources, if destroyed, server can't be reused.
+// It gracefully drains in-flight requests via http.Server.Shutdown, giving them
+// up to timeout to complete; if that deadline passes, the listener and any
+// still-open connections are forced closed with srv.Close(). A timeout <= 0
+// means wait forever for in-flight requests to finish.
+// if timeout, server already destroyed, or Start hasn't reached Serve yet,
+// false was returned
 func (s *Server) Destroy(timeout time.Duration) bool {
-	if !atomic.CompareAndSwapInt32(&s.state, _NORMAL, _DESTROYED) { // signal close idle connections
+	if !atomic.CompareAndSwapInt32(&s.state, _NORMAL, _DESTROYED) {
+		return false
+	}
+
+	_, srv := s.getSrv()
+	if srv == nil {
+		// Start hasn't finished listening yet(e.g. Run's signal handler fired
+		// before Start got there); nothing to shut down. Let the racing Start
+		// proceed undisturbed rather than nil-dereferencing srv.
+		atomic.StoreInt32(&s.state, _NORMAL)
 		return false
 	}
 
-	var isTimeout = true
-	s.warnLog(s.listener.Close()) // don't accept connections
+	ctx := context.Background()
 	if timeout > 0 {
-		c := make(chan struct{})
-		go func(s *Server, c chan struct{}) {
-			s.activeConns.Wait() // wait connections in service to be idle
-			close(c)
-		}(s, c)
-
-		select {
-		case <-time.NewTicker(timeout).C:
-		case <-c:
-			isTimeout = false
-		}
-	} else {
-		s.activeConns.Wait() // wait connections in service to be idle
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	isTimeout := false
+	if err := srv.Shutdown(ctx); err != nil {
+		isTimeout = true
+		s.warnLog(srv.Close())
+	}
+	s.destroyDiagnostics(timeout)
+	if s.acmeSrv != nil {
+		s.warnLog(s.acmeSrv.Shutdown(ctx))
 	}
 
 	// release resources
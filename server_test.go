@@ -0,0 +1,62 @@
+package zerver
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForListener polls until Start has published a listener via setSrv, or
+// fails the test if it takes too long.
+func waitForListener(t *testing.T, s *Server) net.Listener {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if ln, _ := s.getSrv(); ln != nil {
+			return ln
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start listening in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServerStartDestroyGracefulShutdown(t *testing.T) {
+	s := NewServer()
+
+	started := make(chan error, 1)
+	go func() { started <- s.Start(&ServerOption{ListenAddr: "127.0.0.1:0"}) }()
+
+	waitForListener(t, s)
+
+	if !s.Destroy(time.Second) {
+		t.Fatal("Destroy returned false for a running server")
+	}
+
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatalf("Start returned %v after a graceful Destroy", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start did not return after Destroy")
+	}
+
+	if s.Destroy(time.Second) {
+		t.Fatal("Destroy on an already-destroyed server should return false")
+	}
+}
+
+func TestServerDestroyBeforeStartListensIsNoop(t *testing.T) {
+	s := NewServer()
+
+	if s.Destroy(time.Second) {
+		t.Fatal("Destroy before Start reaches Serve should return false")
+	}
+	if atomic.LoadInt32(&s.state) != _NORMAL {
+		t.Fatal("Destroy left state != _NORMAL, a racing Start can no longer proceed")
+	}
+}
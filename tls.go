@@ -0,0 +1,269 @@
+package zerver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/cosiner/gohper/crypto/tls2"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type (
+	// CertPair is one certificate/key file pair. Server matches the right
+	// pair for a handshake by the names in the certificate itself(including
+	// SNI via tls.Config.GetCertificate), so multiple pairs for different
+	// hostnames can be served off the same listener.
+	CertPair struct {
+		CertFile, KeyFile string
+	}
+
+	// AutocertConfig plugs golang.org/x/crypto/acme/autocert into listen,
+	// fetching and renewing certificates from Let's Encrypt(or another ACME
+	// CA) instead of reading them from disk.
+	AutocertConfig struct {
+		// HostWhitelist restricts which hostnames autocert will fetch
+		// certificates for, required: without it anyone pointing DNS at
+		// this server's IP could make it request certs on their behalf
+		HostWhitelist []string
+		// CacheDir persists issued certificates across restarts, default
+		// current directory's "certs" via autocert.DirCache
+		CacheDir string
+	}
+
+	// certFile is one loaded, disk-backed certificate tracked for reload
+	certFile struct {
+		pair  CertPair
+		mtime int64
+	}
+)
+
+// certManager serves SNI-selected certificates out of a small in-memory
+// cache, reloading a certificate from disk when its file's mtime changes or
+// when Reload is called explicitly(e.g. from a SIGHUP handler). It never
+// touches already-established connections: tls.Config.GetCertificate is only
+// consulted for new handshakes, so rotation can't drop keep-alives.
+type certManager struct {
+	mu    sync.RWMutex
+	certs []certFile
+	cache map[string]*tls.Certificate // CertFile path -> loaded cert
+}
+
+func newCertManager(pairs []CertPair) (*certManager, error) {
+	m := &certManager{cache: make(map[string]*tls.Certificate, len(pairs))}
+	for _, p := range pairs {
+		m.certs = append(m.certs, certFile{pair: p})
+	}
+
+	if err := m.reloadAll(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *certManager) reloadAll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.certs {
+		if err := m.loadLocked(&m.certs[i]); err != nil {
+			return fmt.Errorf("zerver: loading cert %q: %w", m.certs[i].pair.CertFile, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *certManager) loadLocked(cf *certFile) error {
+	info, err := os.Stat(cf.pair.CertFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cf.pair.CertFile, cf.pair.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	cf.mtime = info.ModTime().UnixNano()
+	m.cache[cf.pair.CertFile] = &cert
+
+	return nil
+}
+
+// Reload re-reads every certificate pair from disk, regardless of mtime.
+// Call this from a SIGHUP handler to force a rotation outside of the
+// automatic mtime check done on every handshake.
+func (m *certManager) Reload() error {
+	return m.reloadAll()
+}
+
+// reloadIfChanged reloads cf from disk if its file's mtime has moved on
+// since it was last loaded
+func (m *certManager) reloadIfChanged(cf *certFile) {
+	info, err := os.Stat(cf.pair.CertFile)
+	if err != nil {
+		return // keep serving the last good certificate
+	}
+
+	m.mu.RLock()
+	changed := info.ModTime().UnixNano() != cf.mtime
+	m.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_ = m.loadLocked(cf)
+}
+
+// GetCertificate implements tls.Config.GetCertificate: it picks the first
+// certificate whose names match the handshake's SNI server name, falling
+// back to the first configured certificate for clients that don't send SNI.
+func (m *certManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for i := range m.certs {
+		m.reloadIfChanged(&m.certs[i])
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for i := range m.certs {
+		cert := m.cache[m.certs[i].pair.CertFile]
+		if cert == nil || hello.ServerName == "" {
+			continue
+		}
+		leaf := cert.Leaf
+		if leaf == nil {
+			var err error
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				continue
+			}
+		}
+		if leaf.VerifyHostname(hello.ServerName) == nil {
+			return cert, nil
+		}
+	}
+
+	if len(m.certs) > 0 {
+		if cert := m.cache[m.certs[0].pair.CertFile]; cert != nil {
+			return cert, nil
+		}
+	}
+
+	return nil, fmt.Errorf("zerver: no certificate available for %q", hello.ServerName)
+}
+
+// buildAutocertManager builds an autocert.Manager restricted to cfg's
+// whitelist, caching issued certificates under cfg.CacheDir
+func buildAutocertManager(cfg *AutocertConfig) *autocert.Manager {
+	cacheDir := cfg.CacheDir
+	if cacheDir == "" {
+		cacheDir = "certs"
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.HostWhitelist...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+}
+
+// buildTLSConfig assembles the tls.Config used by Server.listen from opt,
+// returning (nil, nil, nil) if TLS wasn't configured at all
+func (s *Server) buildTLSConfig(opt *ServerOption) (*tls.Config, *certManager, error) {
+	switch {
+	case opt.TLSConfig != nil:
+		return opt.TLSConfig, nil, nil
+
+	case opt.Autocert != nil:
+		am := buildAutocertManager(opt.Autocert)
+		tc := &tls.Config{GetCertificate: am.GetCertificate}
+		if err := s.startAutocertChallengeServer(am); err != nil {
+			return nil, nil, err
+		}
+		if err := applyClientCAs(tc, opt.CAs); err != nil {
+			return nil, nil, err
+		}
+
+		return tc, nil, nil
+
+	case len(opt.Certificates) > 0 || opt.CertFile != "":
+		pairs := opt.Certificates
+		if opt.CertFile != "" {
+			pairs = append([]CertPair{{CertFile: opt.CertFile, KeyFile: opt.KeyFile}}, pairs...)
+		}
+
+		cm, err := newCertManager(pairs)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tc := &tls.Config{GetCertificate: cm.GetCertificate}
+		if err := applyClientCAs(tc, opt.CAs); err != nil {
+			return nil, nil, err
+		}
+
+		return tc, cm, nil
+
+	default:
+		return nil, nil, nil
+	}
+}
+
+// applyClientCAs wires cas(PEM file paths) into tc as trusted client
+// certificate authorities and requires/verifies client certs against them,
+// shared by every TLS mode(disk certs, SNI, Autocert) so mutual TLS keeps
+// working no matter how the server certificate is sourced
+func applyClientCAs(tc *tls.Config, cas []string) error {
+	if cas == nil {
+		return nil
+	}
+
+	pool, err := tls2.CAPool(cas...)
+	if err != nil {
+		return err
+	}
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return nil
+}
+
+// startAutocertChallengeServer binds ":80" to answer ACME HTTP-01 challenges,
+// as required by autocert.Manager when it isn't also handling plain HTTP
+// traffic on port 80 itself
+func (s *Server) startAutocertChallengeServer(am *autocert.Manager) error {
+	ln, err := net.Listen("tcp", ":80")
+	if err != nil {
+		return err
+	}
+
+	s.acmeSrv = &http.Server{Handler: am.HTTPHandler(nil)}
+	go func() {
+		if err := s.acmeSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.warnLog(err)
+		}
+	}()
+
+	return nil
+}
+
+// ReloadTLS forces every disk-backed certificate pair to be re-read now,
+// regardless of mtime. It's a no-op if the server wasn't started with
+// ServerOption.Certificates/CertFile(autocert and a caller-supplied TLSConfig
+// manage their own rotation). Hook this up to a SIGHUP handler, Run already
+// does so automatically.
+func (s *Server) ReloadTLS() error {
+	if s.certMgr == nil {
+		return nil
+	}
+
+	return s.certMgr.Reload()
+}
@@ -0,0 +1,162 @@
+package zerver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert generates a self-signed certificate for host and
+// writes the PEM-encoded cert/key to dir, returning their paths.
+func writeSelfSignedCert(t *testing.T, dir, host string) (certPath, keyPath string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+
+	certPath = filepath.Join(dir, host+"-cert.pem")
+	keyPath = filepath.Join(dir, host+"-key.pem")
+
+	certOut, err := os.Create(certPath)
+	if err != nil {
+		t.Fatalf("create cert file: %v", err)
+	}
+	defer certOut.Close()
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		t.Fatalf("encode cert: %v", err)
+	}
+
+	keyOut, err := os.Create(keyPath)
+	if err != nil {
+		t.Fatalf("create key file: %v", err)
+	}
+	defer keyOut.Close()
+	if err := pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}); err != nil {
+		t.Fatalf("encode key: %v", err)
+	}
+
+	return certPath, keyPath
+}
+
+func TestCertManagerGetCertificateSNI(t *testing.T) {
+	dir := t.TempDir()
+	certA, keyA := writeSelfSignedCert(t, dir, "a.example.com")
+	certB, keyB := writeSelfSignedCert(t, dir, "b.example.com")
+
+	cm, err := newCertManager([]CertPair{
+		{CertFile: certA, KeyFile: keyA},
+		{CertFile: certB, KeyFile: keyB},
+	})
+	if err != nil {
+		t.Fatalf("newCertManager: %v", err)
+	}
+
+	cert, err := cm.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"})
+	if err != nil {
+		t.Fatalf("GetCertificate(b): %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	if leaf.Subject.CommonName != "b.example.com" {
+		t.Fatalf("GetCertificate(b) picked %q", leaf.Subject.CommonName)
+	}
+
+	// no SNI sent: falls back to the first configured pair
+	cert, err = cm.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetCertificate(no SNI): %v", err)
+	}
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	if leaf.Subject.CommonName != "a.example.com" {
+		t.Fatalf("GetCertificate(no SNI) picked %q, want fallback a.example.com", leaf.Subject.CommonName)
+	}
+}
+
+func TestCertManagerReloadOnMtimeChange(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeSelfSignedCert(t, dir, "reload.example.com")
+
+	cm, err := newCertManager([]CertPair{{CertFile: certPath, KeyFile: keyPath}})
+	if err != nil {
+		t.Fatalf("newCertManager: %v", err)
+	}
+
+	before, err := cm.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+
+	// rewrite with a fresh cert/key and bump mtime forward so the next
+	// handshake picks it up without an explicit Reload call
+	time.Sleep(10 * time.Millisecond)
+	writeSelfSignedCert(t, dir, "reload.example.com")
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certPath, future, future); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	after, err := cm.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetCertificate after reload: %v", err)
+	}
+
+	if string(before.Certificate[0]) == string(after.Certificate[0]) {
+		t.Fatal("GetCertificate did not pick up the rewritten certificate after mtime changed")
+	}
+}
+
+func TestApplyClientCAs(t *testing.T) {
+	dir := t.TempDir()
+	caCert, _ := writeSelfSignedCert(t, dir, "ca.example.com")
+
+	tc := &tls.Config{}
+	if err := applyClientCAs(tc, []string{caCert}); err != nil {
+		t.Fatalf("applyClientCAs: %v", err)
+	}
+
+	if tc.ClientCAs == nil {
+		t.Fatal("ClientCAs was not set")
+	}
+	if tc.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("ClientAuth = %v, want RequireAndVerifyClientCert", tc.ClientAuth)
+	}
+
+	tc2 := &tls.Config{}
+	if err := applyClientCAs(tc2, nil); err != nil {
+		t.Fatalf("applyClientCAs(nil): %v", err)
+	}
+	if tc2.ClientCAs != nil || tc2.ClientAuth != tls.NoClientCert {
+		t.Fatal("applyClientCAs(nil) should leave tc untouched")
+	}
+}